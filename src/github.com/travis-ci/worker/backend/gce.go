@@ -1,18 +1,22 @@
 package backend
 
 import (
-	"crypto/x509"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/pborman/uuid"
 	"github.com/pkg/sftp"
 	"github.com/travis-ci/worker/config"
@@ -21,8 +25,10 @@ import (
 	"golang.org/x/crypto/ssh"
 	gocontext "golang.org/x/net/context"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/compute/v1"
+	oslogin "google.golang.org/api/oslogin/v1"
 )
 
 const (
@@ -32,29 +38,71 @@ const (
 	defaultGCEDiskSize    = int64(20)
 	defaultGCELanguage    = "minimal"
 	gceImagesFilter       = "name eq ^travis-ci-%s.+"
-	gceStartupScript      = `#!/usr/bin/env bash
-cat > ~travis/.ssh/authorized_keys <<EOF
-%s
-EOF
-`
+
+	credentialsSourceAccountJSON = "account_json"
+	credentialsSourceDefault     = "default"
+	credentialsSourceVault       = "vault"
+	defaultCredentialsSource     = credentialsSourceAccountJSON
+
+	gceWarmPoolLabel        = "travis-warm"
+	gceClaimedLabel         = "travis-claimed"
+	defaultWarmPoolMaxAge   = 30 * time.Minute
+	gceWarmPoolFillInterval = 30 * time.Second
+
+	defaultInsertOperationTimeout = 4 * time.Minute
+	defaultDeleteOperationTimeout = 2 * time.Minute
+	opPollInitialInterval         = 1 * time.Second
+	opPollMaxInterval             = 10 * time.Second
+
+	// defaultSSHKeyTTL needs to outlive the longest build travis-ci.com
+	// allows, not just the time it takes to boot, since a build that
+	// reconnects mid-way through (e.g. after a network blip) relies on
+	// the same key still being authorized.
+	defaultSSHKeyTTL = 3 * time.Hour
+
+	maxUploadScriptAttempts = 10
+
+	confidentialMachineFamily = "n2d"
 )
 
 var (
 	gceHelp = fmt.Sprintf(`
              PROJECT_ID - [REQUIRED] GCE project id
-           ACCOUNT_JSON - [REQUIRED] account JSON config
-           SSH_KEY_PATH - [REQUIRED] path to ssh key used to access job vms
-       SSH_PUB_KEY_PATH - [REQUIRED] path to ssh public key used to access job vms
-     SSH_KEY_PASSPHRASE - [REQUIRED] passphrase for ssh key given as ssh_key_path
+     CREDENTIALS_SOURCE - how to obtain API credentials: %q, %q, or %q (default %q)
+           ACCOUNT_JSON - [REQUIRED if CREDENTIALS_SOURCE=account_json] account JSON config
+             VAULT_ADDR - [REQUIRED if CREDENTIALS_SOURCE=vault] address of the Vault server
+            VAULT_TOKEN - [REQUIRED if CREDENTIALS_SOURCE=vault] token used to authenticate to Vault
+       VAULT_OAUTH_PATH - [REQUIRED if CREDENTIALS_SOURCE=vault] Vault path holding the OAuth token
+               OS_LOGIN - "true" to authorize the job-generated ssh key via OS Login and authenticate as that user's POSIX account
+          OS_LOGIN_USER - [REQUIRED if OS_LOGIN=true] email of the OS Login user to authenticate as
                    ZONE - zone name (default %q)
            MACHINE_TYPE - machine name (default %q)
                 NETWORK - machine name (default %q)
+             SUBNETWORK - subnetwork name, resolved within the region of ZONE
+        USE_INTERNAL_IP - "true" to omit an external IP and ssh to the instance's internal address
+                   TAGS - comma-delimited firewall tags, appended to the default "testing"/language tags
+            PREEMPTIBLE - "false" to request a standard (non-preemptible) instance (default true)
+       ACCELERATOR_TYPE - accelerator (GPU) type to attach, e.g. "nvidia-tesla-k80"
+      ACCELERATOR_COUNT - number of accelerators of ACCELERATOR_TYPE to attach
+   SHIELDED_SECURE_BOOT - "true" to enable UEFI secure boot on the instance
+          SHIELDED_VTPM - "true" to enable the virtual trusted platform module
+SHIELDED_INTEGRITY_MONITORING - "true" to enable shielded VM integrity monitoring
+   CONFIDENTIAL_COMPUTE - "true" to enable Confidential Computing (forces an %q-family MACHINE_TYPE)
               DISK_SIZE - disk size in GB (default %v)
       LANGUAGE_MAPPINGS - key=value comma-delimited pairs for image lookup
        DEFAULT_LANGUAGE - default language to use when looking up image (default %q)
-
-`, defaultGCEZone, defaultGCEMachineType, defaultGCENetwork,
-		defaultGCEDiskSize, defaultGCELanguage)
+         WARM_POOL_SIZE - language=count comma-delimited pairs of warm instances to keep running per image
+      WARM_POOL_MAX_AGE - max age of a warm instance before it is reaped (default %v)
+      OPERATION_TIMEOUT - deadline for a single zone operation to reach DONE (default %v for insert, %v for delete)
+            SSH_KEY_TTL - how long the per-build ssh key stays authorized on the instance (default %v)
+                 LABELS - key=value comma-delimited pairs applied as static instance labels
+               METADATA - key=value comma-delimited pairs appended to the instance's metadata
+
+`, credentialsSourceAccountJSON, credentialsSourceDefault, credentialsSourceVault, defaultCredentialsSource,
+		defaultGCEZone, defaultGCEMachineType, defaultGCENetwork,
+		confidentialMachineFamily,
+		defaultGCEDiskSize, defaultGCELanguage, defaultWarmPoolMaxAge,
+		defaultInsertOperationTimeout, defaultDeleteOperationTimeout, defaultSSHKeyTTL)
 	gceMissingIPAddressError = fmt.Errorf("no IP address found")
 )
 
@@ -88,16 +136,40 @@ type GCEProvider struct {
 
 	defaultLanguage  string
 	languageMappings map[string]string
+
+	warmPool    *GCEWarmPool
+	loginClient *oslogin.Service
+
+	insertOperationTimeout time.Duration
+	deleteOperationTimeout time.Duration
+	sshKeyTTL              time.Duration
+
+	staticLabels  map[string]string
+	extraMetadata []*compute.MetadataItems
 }
 
 type gceInstanceConfig struct {
-	MachineType  *compute.MachineType
-	Zone         *compute.Zone
-	Network      *compute.Network
-	DiskType     string
-	DiskSize     int64
-	SSHKeySigner ssh.Signer
-	SSHPubKey    string
+	MachineType *compute.MachineType
+	Zone        *compute.Zone
+	Network     *compute.Network
+	Subnetwork  *compute.Subnetwork
+	DiskType    string
+	DiskSize    int64
+
+	OSLogin     bool
+	OSLoginUser string
+
+	UseInternalIP bool
+	ExtraTags     []string
+	Preemptible   bool
+
+	AcceleratorType  string
+	AcceleratorCount int64
+
+	ShieldedSecureBoot          bool
+	ShieldedVtpm                bool
+	ShieldedIntegrityMonitoring bool
+	ConfidentialCompute         bool
 }
 
 type GCEInstance struct {
@@ -106,14 +178,25 @@ type GCEInstance struct {
 	instance *compute.Instance
 	ic       *gceInstanceConfig
 
-	authUser string
+	// zone is the zone the instance actually lives in, which for a warm
+	// pool claim may differ from ic.Zone (AggregatedList spans every zone
+	// in the project, not just the provider's configured one).
+	zone string
+
+	authUser     string
+	sshKeySigner ssh.Signer
 
 	projectID string
 	imageName string
 }
 
 func NewGCEProvider(cfg *config.ProviderConfig) (*GCEProvider, error) {
-	client, err := buildGoogleComputeService(cfg)
+	// backend.NewProvider doesn't hand constructors a context, so the
+	// warm pool (the only thing here that outlives this call) gets one
+	// of its own rather than tying its lifetime to a caller we don't have.
+	ctx := gocontext.Background()
+
+	client, httpClient, err := buildGoogleComputeService(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -124,54 +207,18 @@ func NewGCEProvider(cfg *config.ProviderConfig) (*GCEProvider, error) {
 
 	projectID := cfg.Get("PROJECT_ID")
 
-	if !cfg.IsSet("SSH_KEY_PATH") {
-		return nil, fmt.Errorf("expected SSH_KEY_PATH config key")
-	}
-
-	sshKeyPath := cfg.Get("SSH_KEY_PATH")
-
-	if !cfg.IsSet("SSH_PUB_KEY_PATH") {
-		return nil, fmt.Errorf("expected SSH_PUB_KEY_PATH config key")
-	}
-
-	sshKeyBytes, err := ioutil.ReadFile(sshKeyPath)
-
-	if err != nil {
-		return nil, err
-	}
-
-	sshPubKeyPath := cfg.Get("SSH_PUB_KEY_PATH")
-
-	if !cfg.IsSet("SSH_KEY_PASSPHRASE") {
-		return nil, fmt.Errorf("expected SSH_KEY_PASSPHRASE config key")
-	}
+	osLogin := cfg.IsSet("OS_LOGIN") && cfg.Get("OS_LOGIN") == "true"
 
-	sshPubKeyBytes, err := ioutil.ReadFile(sshPubKeyPath)
-
-	if err != nil {
-		return nil, err
-	}
-
-	sshKeyPassphrase := cfg.Get("SSH_KEY_PASSPHRASE")
-
-	block, _ := pem.Decode(sshKeyBytes)
-	if block == nil {
-		return nil, fmt.Errorf("ssh key does not contain a valid PEM block")
-	}
-
-	der, err := x509.DecryptPEMBlock(block, []byte(sshKeyPassphrase))
-	if err != nil {
-		return nil, err
-	}
-
-	parsedKey, err := x509.ParsePKCS1PrivateKey(der)
-	if err != nil {
-		return nil, err
-	}
+	var loginClient *oslogin.Service
+	if osLogin {
+		if !cfg.IsSet("OS_LOGIN_USER") {
+			return nil, fmt.Errorf("expected OS_LOGIN_USER config key")
+		}
 
-	sshKeySigner, err := ssh.NewSignerFromKey(parsedKey)
-	if err != nil {
-		return nil, err
+		loginClient, err = oslogin.New(httpClient)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	zoneName := defaultGCEZone
@@ -189,6 +236,11 @@ func NewGCEProvider(cfg *config.ProviderConfig) (*GCEProvider, error) {
 		mtName = cfg.Get("MACHINE_TYPE")
 	}
 
+	confidentialCompute := cfg.IsSet("CONFIDENTIAL_COMPUTE") && cfg.Get("CONFIDENTIAL_COMPUTE") == "true"
+	if confidentialCompute {
+		mtName = confidentialMachineTypeName(mtName)
+	}
+
 	mt, err := client.MachineTypes.Get(projectID, zone.Name, mtName).Do()
 	if err != nil {
 		return nil, err
@@ -204,6 +256,45 @@ func NewGCEProvider(cfg *config.ProviderConfig) (*GCEProvider, error) {
 		return nil, err
 	}
 
+	var subnetwork *compute.Subnetwork
+	if cfg.IsSet("SUBNETWORK") {
+		subnetwork, err = client.Subnetworks.Get(projectID, lastURLComponent(zone.Region), cfg.Get("SUBNETWORK")).Do()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	useInternalIP := cfg.IsSet("USE_INTERNAL_IP") && cfg.Get("USE_INTERNAL_IP") == "true"
+
+	extraTags := []string{}
+	if cfg.IsSet("TAGS") {
+		for _, tag := range strings.Split(cfg.Get("TAGS"), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				extraTags = append(extraTags, tag)
+			}
+		}
+	}
+
+	preemptible := true
+	if cfg.IsSet("PREEMPTIBLE") {
+		preemptible, err = strconv.ParseBool(cfg.Get("PREEMPTIBLE"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	acceleratorCount := int64(0)
+	if cfg.IsSet("ACCELERATOR_COUNT") {
+		acceleratorCount, err = strconv.ParseInt(cfg.Get("ACCELERATOR_COUNT"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shieldedSecureBoot := cfg.IsSet("SHIELDED_SECURE_BOOT") && cfg.Get("SHIELDED_SECURE_BOOT") == "true"
+	shieldedVtpm := cfg.IsSet("SHIELDED_VTPM") && cfg.Get("SHIELDED_VTPM") == "true"
+	shieldedIntegrityMonitoring := cfg.IsSet("SHIELDED_INTEGRITY_MONITORING") && cfg.Get("SHIELDED_INTEGRITY_MONITORING") == "true"
+
 	diskSize := defaultGCEDiskSize
 	if cfg.IsSet("DISK_SIZE") {
 		ds, err := strconv.ParseInt(cfg.Get("DISK_SIZE"), 10, 64)
@@ -227,43 +318,248 @@ func NewGCEProvider(cfg *config.ProviderConfig) (*GCEProvider, error) {
 		}
 	}
 
-	return &GCEProvider{
+	staticLabels := map[string]string{}
+	if cfg.IsSet("LABELS") {
+		for _, pair := range strings.Split(cfg.Get("LABELS"), ",") {
+			kv := strings.Split(strings.TrimSpace(pair), "=")
+			if len(kv) == 2 {
+				staticLabels[kv[0]] = kv[1]
+			}
+		}
+	}
+
+	extraMetadata := []*compute.MetadataItems{}
+	if cfg.IsSet("METADATA") {
+		for _, pair := range strings.Split(cfg.Get("METADATA"), ",") {
+			kv := strings.Split(strings.TrimSpace(pair), "=")
+			if len(kv) == 2 {
+				extraMetadata = append(extraMetadata, &compute.MetadataItems{Key: kv[0], Value: kv[1]})
+			}
+		}
+	}
+
+	warmPoolSizes := map[string]int{}
+	if cfg.IsSet("WARM_POOL_SIZE") {
+		for _, pair := range strings.Split(cfg.Get("WARM_POOL_SIZE"), ",") {
+			kv := strings.Split(strings.TrimSpace(pair), "=")
+			if len(kv) != 2 {
+				continue
+			}
+
+			size, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid WARM_POOL_SIZE entry %q: %v", pair, err)
+			}
+
+			warmPoolSizes[kv[0]] = size
+		}
+	}
+
+	warmPoolMaxAge := defaultWarmPoolMaxAge
+	if cfg.IsSet("WARM_POOL_MAX_AGE") {
+		warmPoolMaxAge, err = time.ParseDuration(cfg.Get("WARM_POOL_MAX_AGE"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	insertOperationTimeout := defaultInsertOperationTimeout
+	deleteOperationTimeout := defaultDeleteOperationTimeout
+	if cfg.IsSet("OPERATION_TIMEOUT") {
+		operationTimeout, err := time.ParseDuration(cfg.Get("OPERATION_TIMEOUT"))
+		if err != nil {
+			return nil, err
+		}
+		insertOperationTimeout = operationTimeout
+		deleteOperationTimeout = operationTimeout
+	}
+
+	sshKeyTTL := defaultSSHKeyTTL
+	if cfg.IsSet("SSH_KEY_TTL") {
+		sshKeyTTL, err = time.ParseDuration(cfg.Get("SSH_KEY_TTL"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := &GCEProvider{
 		client:           client,
 		projectID:        projectID,
 		defaultLanguage:  defaultLanguage,
 		languageMappings: languageMappings,
+		loginClient:      loginClient,
+
+		insertOperationTimeout: insertOperationTimeout,
+		deleteOperationTimeout: deleteOperationTimeout,
+		sshKeyTTL:              sshKeyTTL,
+
+		staticLabels:  staticLabels,
+		extraMetadata: extraMetadata,
+
 		ic: &gceInstanceConfig{
-			MachineType:  mt,
-			Zone:         zone,
-			Network:      nw,
-			DiskType:     fmt.Sprintf("zones/%s/diskTypes/pd-standard", zone.Name),
-			DiskSize:     diskSize,
-			SSHKeySigner: sshKeySigner,
-			SSHPubKey:    string(sshPubKeyBytes),
+			MachineType: mt,
+			Zone:        zone,
+			Network:     nw,
+			Subnetwork:  subnetwork,
+			DiskType:    fmt.Sprintf("zones/%s/diskTypes/pd-standard", zone.Name),
+			DiskSize:    diskSize,
+			OSLogin:     osLogin,
+			OSLoginUser: cfg.Get("OS_LOGIN_USER"),
+
+			UseInternalIP: useInternalIP,
+			ExtraTags:     extraTags,
+			Preemptible:   preemptible,
+
+			AcceleratorType:  cfg.Get("ACCELERATOR_TYPE"),
+			AcceleratorCount: acceleratorCount,
+
+			ShieldedSecureBoot:          shieldedSecureBoot,
+			ShieldedVtpm:                shieldedVtpm,
+			ShieldedIntegrityMonitoring: shieldedIntegrityMonitoring,
+			ConfidentialCompute:         confidentialCompute,
 		},
-	}, nil
+	}
+
+	if len(warmPoolSizes) > 0 {
+		p.warmPool = newGCEWarmPool(p, warmPoolSizes, warmPoolMaxAge)
+		go p.warmPool.Run(ctx)
+	}
+
+	return p, nil
 }
 
-func buildGoogleComputeService(cfg *config.ProviderConfig) (*compute.Service, error) {
-	if !cfg.IsSet("ACCOUNT_JSON") {
-		return nil, fmt.Errorf("missing ACCOUNT_JSON")
+func buildGoogleComputeService(ctx gocontext.Context, cfg *config.ProviderConfig) (*compute.Service, *http.Client, error) {
+	src, err := buildGoogleTokenSource(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	a, err := loadGoogleAccountJSON(cfg.Get("ACCOUNT_JSON"))
+	httpClient := oauth2.NewClient(ctx, src)
+
+	svc, err := compute.New(httpClient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return svc, httpClient, nil
+}
+
+// buildGoogleTokenSource selects an oauth2.TokenSource based on the
+// CREDENTIALS_SOURCE config key, defaulting to the legacy ACCOUNT_JSON JWT
+// flow. The returned source is wrapped in oauth2.ReuseTokenSource so tokens
+// are cached until they expire.
+func buildGoogleTokenSource(ctx gocontext.Context, cfg *config.ProviderConfig) (oauth2.TokenSource, error) {
+	credentialsSource := defaultCredentialsSource
+	if cfg.IsSet("CREDENTIALS_SOURCE") {
+		credentialsSource = cfg.Get("CREDENTIALS_SOURCE")
+	}
+
+	switch credentialsSource {
+	case credentialsSourceDefault:
+		src, err := google.DefaultTokenSource(ctx, compute.ComputeScope, compute.DevstorageFullControlScope)
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.ReuseTokenSource(nil, src), nil
+	case credentialsSourceVault:
+		src, err := newVaultTokenSource(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.ReuseTokenSource(nil, src), nil
+	case credentialsSourceAccountJSON:
+		if !cfg.IsSet("ACCOUNT_JSON") {
+			return nil, fmt.Errorf("missing ACCOUNT_JSON")
+		}
+
+		a, err := loadGoogleAccountJSON(cfg.Get("ACCOUNT_JSON"))
+		if err != nil {
+			return nil, err
+		}
+
+		jwtConfig := jwt.Config{
+			Email:      a.ClientEmail,
+			PrivateKey: []byte(a.PrivateKey),
+			Scopes: []string{
+				compute.DevstorageFullControlScope,
+				compute.ComputeScope,
+			},
+			TokenURL: "https://accounts.google.com/o/oauth2/token",
+		}
+		return oauth2.ReuseTokenSource(nil, jwtConfig.TokenSource(ctx)), nil
+	default:
+		return nil, fmt.Errorf("unknown CREDENTIALS_SOURCE %q", credentialsSource)
+	}
+}
+
+// vaultTokenSource is an oauth2.TokenSource backed by a Vault secret. The
+// secret at path is expected to hold "token", "expires_at" (RFC 3339), and
+// optionally "refresh_token" fields, matching the shape produced by Vault's
+// Google Cloud secrets engine.
+type vaultTokenSource struct {
+	client *vaultapi.Client
+	path   string
+}
+
+func newVaultTokenSource(cfg *config.ProviderConfig) (*vaultTokenSource, error) {
+	if !cfg.IsSet("VAULT_ADDR") {
+		return nil, fmt.Errorf("expected VAULT_ADDR config key")
+	}
+
+	if !cfg.IsSet("VAULT_TOKEN") {
+		return nil, fmt.Errorf("expected VAULT_TOKEN config key")
+	}
+
+	if !cfg.IsSet("VAULT_OAUTH_PATH") {
+		return nil, fmt.Errorf("expected VAULT_OAUTH_PATH config key")
+	}
+
+	vaultConfig := vaultapi.DefaultConfig()
+	vaultConfig.Address = cfg.Get("VAULT_ADDR")
+
+	client, err := vaultapi.NewClient(vaultConfig)
 	if err != nil {
 		return nil, err
 	}
+	client.SetToken(cfg.Get("VAULT_TOKEN"))
 
-	config := jwt.Config{
-		Email:      a.ClientEmail,
-		PrivateKey: []byte(a.PrivateKey),
-		Scopes: []string{
-			compute.DevstorageFullControlScope,
-			compute.ComputeScope,
-		},
-		TokenURL: "https://accounts.google.com/o/oauth2/token",
+	return &vaultTokenSource{client: client, path: cfg.Get("VAULT_OAUTH_PATH")}, nil
+}
+
+func (v *vaultTokenSource) Token() (*oauth2.Token, error) {
+	secret, err := v.client.Logical().Read(v.path)
+	if err != nil {
+		return nil, err
 	}
-	return compute.New(config.Client(oauth2.NoContext))
+
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no oauth token found at vault path %q", v.path)
+	}
+
+	token, ok := secret.Data["token"].(string)
+	if !ok || token == "" {
+		return nil, fmt.Errorf("vault path %q did not contain a token field", v.path)
+	}
+
+	// oauth2.Token treats a zero Expiry as never expiring, so a vault
+	// secret without expires_at must default to something already in the
+	// past rather than time.Time{} or ReuseTokenSource would cache this
+	// token (and never notice rotated Vault credentials) for good.
+	expiry := time.Now()
+	if expiresAt, ok := secret.Data["expires_at"].(string); ok {
+		expiry, err = time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse expires_at from vault path %q: %v", v.path, err)
+		}
+	}
+
+	refreshToken, _ := secret.Data["refresh_token"].(string)
+
+	return &oauth2.Token{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		Expiry:       expiry,
+	}, nil
 }
 
 func loadGoogleAccountJSON(filename string) (*gceAccountJSON, error) {
@@ -302,8 +598,325 @@ func (p *GCEProvider) Start(ctx gocontext.Context, startAttributes *StartAttribu
 		return nil, err
 	}
 
-	inst := &compute.Instance{
-		Description: fmt.Sprintf("Travis CI %s test VM", startAttributes.Language),
+	authUser, signer, sshMetadataItem, err := p.buildSSHAccess(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if warmInst, ok, err := p.claimWarmInstance(ctx, startAttributes, image.Name); err != nil {
+		logger.WithField("err", err).Warn("couldn't claim warm instance, falling back to a fresh insert")
+	} else if ok {
+		metrics.Mark("worker.vm.provider.gce.warmpool.hit")
+
+		if err := p.injectSSHMetadata(ctx, warmInst, sshMetadataItem); err != nil {
+			return nil, err
+		}
+
+		return &GCEInstance{
+			client:   p.client,
+			provider: p,
+			instance: warmInst,
+			ic:       p.ic,
+			zone:     lastURLComponent(warmInst.Zone),
+
+			authUser:     authUser,
+			sshKeySigner: signer,
+
+			projectID: p.projectID,
+			imageName: image.Name,
+		}, nil
+	} else {
+		metrics.Mark("worker.vm.provider.gce.warmpool.miss")
+	}
+
+	inst := p.buildInstance(image, startAttributes.Language, p.jobLabels(ctx, startAttributes), false, []*compute.MetadataItems{sshMetadataItem})
+
+	logger.WithFields(logrus.Fields{
+		"instance": inst,
+	}).Debug("inserting instance")
+	op, err := p.client.Instances.Insert(p.projectID, p.ic.Zone.Name, inst).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	startBooting := time.Now()
+
+	_, err = p.waitForOperation(ctx, p.ic.Zone.Name, op, p.insertOperationTimeout)
+	if err != nil {
+		if err == gocontext.DeadlineExceeded {
+			metrics.Mark("worker.vm.provider.gce.boot.timeout")
+		}
+		return nil, err
+	}
+
+	metrics.TimeSince("worker.vm.provider.gce.boot", startBooting)
+	return &GCEInstance{
+		client:   p.client,
+		provider: p,
+		instance: inst,
+		ic:       p.ic,
+		zone:     p.ic.Zone.Name,
+
+		authUser:     authUser,
+		sshKeySigner: signer,
+
+		projectID: p.projectID,
+		imageName: image.Name,
+	}, nil
+}
+
+const gceSSHKeyBits = 2048
+
+// waitForOperation polls a GCE zone operation until it reaches DONE,
+// backing off exponentially between polls (capped at opPollMaxInterval,
+// with jitter to avoid synchronized polling across workers) and bounding
+// the whole wait by timeout. It returns the completed operation, or a
+// *gceOpError if the operation itself failed.
+func (p *GCEProvider) waitForOperation(ctx gocontext.Context, zoneName string, op *compute.Operation, timeout time.Duration) (*compute.Operation, error) {
+	ctx, cancel := gocontext.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	interval := opPollInitialInterval
+	for {
+		newOp, err := p.client.ZoneOperations.Get(p.projectID, zoneName, op.Name).Do()
+		if err != nil {
+			return nil, err
+		}
+
+		if newOp.Status == "DONE" {
+			if newOp.Error != nil {
+				return nil, &gceOpError{Err: newOp.Error}
+			}
+			return newOp, nil
+		}
+
+		jitter := time.Duration(rand.Int63n(int64(interval)/2 + 1))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval + jitter):
+		}
+
+		interval *= 2
+		if interval > opPollMaxInterval {
+			interval = opPollMaxInterval
+		}
+	}
+}
+
+// buildSSHAccess generates a fresh, per-build ssh keypair and, depending on
+// OSLogin, either uploads the public half to OSLoginUser's OS Login profile
+// (returning the POSIX username GCE will authenticate it as, along with an
+// "enable-oslogin" instance metadata item) or prepares an "ssh-keys"
+// instance metadata item understood by the guest agent. The
+// returned signer is never persisted outside the resulting GCEInstance.
+func (p *GCEProvider) buildSSHAccess(logger *logrus.Entry) (string, ssh.Signer, *compute.MetadataItems, error) {
+	authUser := "travis"
+
+	priv, err := rsa.GenerateKey(cryptorand.Reader, gceSSHKeyBits)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	pubKeyLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+
+	if p.ic.OSLogin {
+		authUser = p.ic.OSLoginUser
+
+		_, err := p.loginClient.Users.SshPublicKeys.Insert(fmt.Sprintf("users/%s", p.ic.OSLoginUser), &oslogin.SshPublicKey{
+			Key:                pubKeyLine,
+			ExpirationTimeUsec: fmt.Sprintf("%d", time.Now().Add(p.sshKeyTTL).UnixNano()/1000),
+		}).Do()
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		profile, err := p.loginClient.Users.GetLoginProfile(fmt.Sprintf("users/%s", p.ic.OSLoginUser)).Do()
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		// Prefer the account marked Primary; fall back to the first one
+		// listed rather than whichever happens to be last, if none is.
+		for i, acct := range profile.PosixAccounts {
+			if i == 0 {
+				authUser = acct.Username
+			}
+			if acct.Primary {
+				authUser = acct.Username
+				break
+			}
+		}
+
+		return authUser, signer, &compute.MetadataItems{Key: "enable-oslogin", Value: "TRUE"}, nil
+	}
+
+	expireOn := time.Now().Add(p.sshKeyTTL).UTC().Format(time.RFC3339)
+	sshKeysValue := fmt.Sprintf(`%s:%s google-ssh {"userName":"%s","expireOn":"%s"}`,
+		authUser, pubKeyLine, authUser, expireOn)
+
+	logger.WithField("fingerprint", sshKeyFingerprintSHA1(pub)).Debug("generated per-build ssh keypair")
+
+	return authUser, signer, &compute.MetadataItems{Key: "ssh-keys", Value: sshKeysValue}, nil
+}
+
+func sshKeyFingerprintSHA1(pub ssh.PublicKey) string {
+	sum := sha1.Sum(pub.Marshal())
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// injectSSHMetadata adds item to a warm instance's metadata once it's
+// claimed for a build, since the pool filler sets it up generically rather
+// than for the specific job about to run on it.
+func (p *GCEProvider) injectSSHMetadata(ctx gocontext.Context, inst *compute.Instance, item *compute.MetadataItems) error {
+	zoneName := lastURLComponent(inst.Zone)
+
+	items := append([]*compute.MetadataItems{}, inst.Metadata.Items...)
+	items = append(items, item)
+
+	op, err := p.client.Instances.SetMetadata(p.projectID, zoneName, inst.Name, &compute.Metadata{
+		Fingerprint: inst.Metadata.Fingerprint,
+		Items:       items,
+	}).Do()
+	if err != nil {
+		return err
+	}
+
+	_, err = p.waitForOperation(ctx, zoneName, op, p.insertOperationTimeout)
+	return err
+}
+
+// jobLabels merges the static LABELS config with per-job dimensions, so
+// billing exports and GCE audit logs can be attributed to the job that
+// caused the spend. repository and job_id come off ctx rather than
+// startAttributes, since that's where the processor stashes them.
+func (p *GCEProvider) jobLabels(ctx gocontext.Context, startAttributes *StartAttributes) map[string]string {
+	labels := map[string]string{}
+	for k, v := range p.staticLabels {
+		labels[k] = v
+	}
+
+	if startAttributes.Language != "" {
+		labels["language"] = gceLabelValue(startAttributes.Language)
+	}
+
+	if repo, ok := context.RepositoryFromContext(ctx); ok && repo != "" {
+		labels["repository"] = gceLabelValue(repo)
+	}
+
+	if jobID, ok := context.JobIDFromContext(ctx); ok {
+		labels["job_id"] = strconv.FormatUint(jobID, 10)
+	}
+
+	return labels
+}
+
+// gceLabelValue sanitizes s to satisfy GCE's label value constraints:
+// lowercase letters, digits, dashes, and underscores only, capped at 63
+// characters. Anything else (e.g. the "/" in a repository slug) becomes
+// a dash.
+func gceLabelValue(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+
+	v := b.String()
+	if len(v) > 63 {
+		v = v[:63]
+	}
+
+	return v
+}
+
+// buildInstance returns the instance template shared by Start and the warm
+// pool filler. isWarmPoolInstance names the instance so it's recognizable
+// as a warm pool placeholder rather than a job's own instance.
+func (p *GCEProvider) buildInstance(image *compute.Image, language string, labels map[string]string, isWarmPoolInstance bool, metadataItems []*compute.MetadataItems) *compute.Instance {
+	name := fmt.Sprintf("testing-gce-%s", uuid.NewUUID())
+	if isWarmPoolInstance {
+		name = fmt.Sprintf("warm-gce-%s", uuid.NewUUID())
+	}
+
+	ni := &compute.NetworkInterface{
+		Network: p.ic.Network.SelfLink,
+	}
+	if p.ic.Subnetwork != nil {
+		ni.Subnetwork = p.ic.Subnetwork.SelfLink
+	}
+	if p.ic.UseInternalIP {
+		ni.AccessConfigs = nil
+	} else {
+		ni.AccessConfigs = []*compute.AccessConfig{
+			&compute.AccessConfig{
+				Name: "AccessConfig brought to you by travis-worker",
+				Type: "ONE_TO_ONE_NAT",
+			},
+		}
+	}
+
+	scheduling := &compute.Scheduling{
+		Preemptible: p.ic.Preemptible,
+	}
+
+	var accelerators []*compute.AcceleratorConfig
+	if p.ic.AcceleratorType != "" && p.ic.AcceleratorCount > 0 {
+		accelerators = []*compute.AcceleratorConfig{
+			&compute.AcceleratorConfig{
+				AcceleratorType:  fmt.Sprintf("zones/%s/acceleratorTypes/%s", p.ic.Zone.Name, p.ic.AcceleratorType),
+				AcceleratorCount: p.ic.AcceleratorCount,
+			},
+		}
+		// GCE requires instances with attached accelerators to terminate
+		// (rather than live-migrate) for host maintenance.
+		scheduling.Preemptible = false
+		scheduling.OnHostMaintenance = "TERMINATE"
+	}
+
+	var shieldedConfig *compute.ShieldedInstanceConfig
+	if p.ic.ShieldedSecureBoot || p.ic.ShieldedVtpm || p.ic.ShieldedIntegrityMonitoring {
+		shieldedConfig = &compute.ShieldedInstanceConfig{
+			EnableSecureBoot:          p.ic.ShieldedSecureBoot,
+			EnableVtpm:                p.ic.ShieldedVtpm,
+			EnableIntegrityMonitoring: p.ic.ShieldedIntegrityMonitoring,
+		}
+	}
+
+	var confidentialConfig *compute.ConfidentialInstanceConfig
+	if p.ic.ConfidentialCompute {
+		confidentialConfig = &compute.ConfidentialInstanceConfig{
+			EnableConfidentialCompute: true,
+		}
+		// Confidential Computing instances can't live-migrate either.
+		scheduling.Preemptible = false
+		scheduling.OnHostMaintenance = "TERMINATE"
+	}
+
+	tags := append([]string{"testing", language}, p.ic.ExtraTags...)
+
+	items := append([]*compute.MetadataItems{}, p.extraMetadata...)
+	items = append(items, metadataItems...)
+
+	return &compute.Instance{
+		Description: fmt.Sprintf("Travis CI %s test VM", language),
 		Disks: []*compute.AttachedDisk{
 			&compute.AttachedDisk{
 				Type:       "PERSISTENT",
@@ -317,30 +930,17 @@ func (p *GCEProvider) Start(ctx gocontext.Context, startAttributes *StartAttribu
 				},
 			},
 		},
-		Scheduling: &compute.Scheduling{
-			Preemptible: true,
-		},
-		MachineType: p.ic.MachineType.SelfLink,
-		Name:        fmt.Sprintf("testing-gce-%s", uuid.NewUUID()),
+		Scheduling:                 scheduling,
+		GuestAccelerators:          accelerators,
+		ShieldedInstanceConfig:     shieldedConfig,
+		ConfidentialInstanceConfig: confidentialConfig,
+		MachineType:                p.ic.MachineType.SelfLink,
+		Name:                       name,
+		Labels:                     labels,
 		Metadata: &compute.Metadata{
-			Items: []*compute.MetadataItems{
-				&compute.MetadataItems{
-					Key:   "startup-script",
-					Value: fmt.Sprintf(gceStartupScript, p.ic.SSHPubKey),
-				},
-			},
-		},
-		NetworkInterfaces: []*compute.NetworkInterface{
-			&compute.NetworkInterface{
-				AccessConfigs: []*compute.AccessConfig{
-					&compute.AccessConfig{
-						Name: "AccessConfig brought to you by travis-worker",
-						Type: "ONE_TO_ONE_NAT",
-					},
-				},
-				Network: p.ic.Network.SelfLink,
-			},
+			Items: items,
 		},
+		NetworkInterfaces: []*compute.NetworkInterface{ni},
 		ServiceAccounts: []*compute.ServiceAccount{
 			&compute.ServiceAccount{
 				Email: "default",
@@ -352,66 +952,206 @@ func (p *GCEProvider) Start(ctx gocontext.Context, startAttributes *StartAttribu
 			},
 		},
 		Tags: &compute.Tags{
-			Items: []string{
-				"testing",
-				startAttributes.Language,
-			},
+			Items: tags,
 		},
 	}
+}
 
-	logger.WithFields(logrus.Fields{
-		"instance": inst,
-	}).Debug("inserting instance")
-	op, err := p.client.Instances.Insert(p.projectID, p.ic.Zone.Name, inst).Do()
+// claimWarmInstance looks for a running instance tagged as part of the warm
+// pool for imageName and atomically claims it by rewriting its labels with
+// the claiming job's own jobLabels (a warm instance otherwise only carries
+// generic pool bookkeeping labels, not the attribution the job needs),
+// relying on the label fingerprint GCE hands back to detect a racing claim
+// from another worker. ok is false (with a nil error) when no warm instance
+// is available and the caller should fall back to a fresh insert.
+func (p *GCEProvider) claimWarmInstance(ctx gocontext.Context, startAttributes *StartAttributes, imageName string) (*compute.Instance, bool, error) {
+	if p.warmPool == nil {
+		return nil, false, nil
+	}
+
+	candidates, err := p.warmPool.instancesForImage(imageName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, inst := range candidates {
+		zoneName := lastURLComponent(inst.Zone)
+
+		claimedBy := inst.Name
+		if jobID, ok := context.JobIDFromContext(ctx); ok {
+			claimedBy = strconv.FormatUint(jobID, 10)
+		}
+
+		labels := map[string]string{}
+		for k, v := range inst.Labels {
+			labels[k] = v
+		}
+		delete(labels, gceWarmPoolLabel)
+		for k, v := range p.jobLabels(ctx, startAttributes) {
+			labels[k] = v
+		}
+		labels[gceClaimedLabel] = claimedBy
+
+		_, err := p.client.Instances.SetLabels(p.projectID, zoneName, inst.Name, &compute.InstancesSetLabelsRequest{
+			Labels:           labels,
+			LabelFingerprint: inst.LabelFingerprint,
+		}).Do()
+		if err != nil {
+			// Lost the race to claim this instance (or it's gone); try the
+			// next candidate instead of failing the whole Start call.
+			continue
+		}
+
+		return inst, true, nil
+	}
+
+	return nil, false, nil
+}
+
+func lastURLComponent(url string) string {
+	parts := strings.Split(url, "/")
+	return parts[len(parts)-1]
+}
+
+// confidentialMachineTypeName rewrites a machine type name onto the
+// confidentialMachineFamily, since Confidential Computing is only
+// available on a subset of machine families (e.g. n2d-standard-2 rather
+// than n1-standard-2). Names already in that family are left alone.
+func confidentialMachineTypeName(mtName string) string {
+	if strings.HasPrefix(mtName, confidentialMachineFamily+"-") {
+		return mtName
+	}
+
+	parts := strings.SplitN(mtName, "-", 2)
+	if len(parts) != 2 {
+		return mtName
+	}
+
+	return fmt.Sprintf("%s-%s", confidentialMachineFamily, parts[1])
+}
+
+// GCEWarmPool keeps a configurable number of already-booted instances per
+// language around so that GCEProvider.Start can skip the usual insert-and-
+// wait-for-boot path. It is owned by a GCEProvider and runs as a background
+// goroutine for the lifetime of the provider.
+type GCEWarmPool struct {
+	provider *GCEProvider
+	sizes    map[string]int
+	maxAge   time.Duration
+}
+
+func newGCEWarmPool(provider *GCEProvider, sizes map[string]int, maxAge time.Duration) *GCEWarmPool {
+	return &GCEWarmPool{provider: provider, sizes: sizes, maxAge: maxAge}
+}
+
+// Run fills and reaps the warm pool until ctx is done.
+func (wp *GCEWarmPool) Run(ctx gocontext.Context) {
+	ticker := time.NewTicker(gceWarmPoolFillInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wp.fill(ctx)
+			wp.reap(ctx)
+		}
+	}
+}
+
+func (wp *GCEWarmPool) instancesForImage(imageName string) ([]*compute.Instance, error) {
+	filter := fmt.Sprintf("labels.%s eq %s", gceWarmPoolLabel, imageName)
+	resp, err := wp.provider.client.Instances.AggregatedList(wp.provider.projectID).Filter(filter).Do()
 	if err != nil {
 		return nil, err
 	}
 
-	startBooting := time.Now()
+	instances := []*compute.Instance{}
+	for _, scoped := range resp.Items {
+		for _, inst := range scoped.Instances {
+			if inst.Labels[gceWarmPoolLabel] == imageName && inst.Labels[gceClaimedLabel] == "" && inst.Status == "RUNNING" {
+				instances = append(instances, inst)
+			}
+		}
+	}
 
-	instanceReady := make(chan *compute.Instance)
-	errChan := make(chan error)
-	go func() {
-		for {
-			newOp, err := p.client.ZoneOperations.Get(p.projectID, p.ic.Zone.Name, op.Name).Do()
-			if err != nil {
-				errChan <- err
-				return
+	return instances, nil
+}
+
+func (wp *GCEWarmPool) fill(ctx gocontext.Context) {
+	logger := context.LoggerFromContext(ctx)
+
+	for language, size := range wp.sizes {
+		image, err := wp.provider.imageForLanguage(language)
+		if err != nil {
+			logger.WithField("err", err).WithField("language", language).Warn("warm pool couldn't resolve image")
+			continue
+		}
+
+		existing, err := wp.instancesForImage(image.Name)
+		if err != nil {
+			logger.WithField("err", err).WithField("image", image.Name).Warn("warm pool couldn't list instances")
+			continue
+		}
+
+		for i := len(existing); i < size; i++ {
+			labels := map[string]string{}
+			for k, v := range wp.provider.staticLabels {
+				labels[k] = v
 			}
+			labels[gceWarmPoolLabel] = image.Name
 
-			if newOp.Status == "DONE" {
-				if newOp.Error != nil {
-					errChan <- &gceOpError{Err: newOp.Error}
-					return
-				}
+			inst := wp.provider.buildInstance(image, language, labels, true, nil)
+
+			op, err := wp.provider.client.Instances.Insert(wp.provider.projectID, wp.provider.ic.Zone.Name, inst).Do()
+			if err != nil {
+				logger.WithField("err", err).WithField("image", image.Name).Warn("warm pool couldn't insert instance")
+				continue
+			}
 
-				instanceReady <- inst
-				return
+			if _, err := wp.provider.waitForOperation(ctx, wp.provider.ic.Zone.Name, op, wp.provider.insertOperationTimeout); err != nil {
+				logger.WithField("err", err).WithField("image", image.Name).Warn("warm pool instance failed to come up")
 			}
 		}
-	}()
+	}
+}
 
-	select {
-	case inst := <-instanceReady:
-		metrics.TimeSince("worker.vm.provider.gce.boot", startBooting)
-		return &GCEInstance{
-			client:   p.client,
-			provider: p,
-			instance: inst,
-			ic:       p.ic,
+func (wp *GCEWarmPool) reap(ctx gocontext.Context) {
+	logger := context.LoggerFromContext(ctx)
 
-			authUser: "travis",
+	filter := fmt.Sprintf("labels.%s ne ''", gceWarmPoolLabel)
+	resp, err := wp.provider.client.Instances.AggregatedList(wp.provider.projectID).Filter(filter).Do()
+	if err != nil {
+		logger.WithField("err", err).Warn("warm pool reaper couldn't list instances")
+		return
+	}
 
-			projectID: p.projectID,
-			imageName: image.Name,
-		}, nil
-	case err := <-errChan:
-		return nil, err
-	case <-ctx.Done():
-		if ctx.Err() == gocontext.DeadlineExceeded {
-			metrics.Mark("worker.vm.provider.gce.boot.timeout")
+	for _, scoped := range resp.Items {
+		for _, inst := range scoped.Instances {
+			// A warm instance that isn't RUNNING (preempted, stopped, or
+			// still provisioning) is reaped immediately regardless of age.
+			// fill doesn't count such an instance toward the pool size
+			// (instancesForImage only returns RUNNING ones) and inserts a
+			// replacement beside it, so it would otherwise linger.
+			if inst.Status == "RUNNING" {
+				created, err := time.Parse(time.RFC3339, inst.CreationTimestamp)
+				if err != nil || time.Since(created) < wp.maxAge {
+					continue
+				}
+			}
+
+			zoneName := lastURLComponent(inst.Zone)
+			op, err := wp.provider.client.Instances.Delete(wp.provider.projectID, zoneName, inst.Name).Do()
+			if err != nil {
+				logger.WithField("err", err).WithField("instance", inst.Name).Warn("warm pool reaper couldn't delete instance")
+				continue
+			}
+
+			if _, err := wp.provider.waitForOperation(ctx, zoneName, op, wp.provider.deleteOperationTimeout); err != nil {
+				logger.WithField("err", err).WithField("instance", inst.Name).Warn("warm pool reaper op failed")
+			}
 		}
-		return nil, ctx.Err()
 	}
 }
 
@@ -449,12 +1189,22 @@ func (i *GCEInstance) sshClient() (*ssh.Client, error) {
 	return ssh.Dial("tcp", fmt.Sprintf("%s:22", ipAddr), &ssh.ClientConfig{
 		User: i.authUser,
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(i.ic.SSHKeySigner),
+			ssh.PublicKeys(i.sshKeySigner),
 		},
 	})
 }
 
 func (i *GCEInstance) getIP() string {
+	if i.ic.UseInternalIP {
+		for _, ni := range i.instance.NetworkInterfaces {
+			if ni.NetworkIP != "" {
+				return ni.NetworkIP
+			}
+		}
+
+		return ""
+	}
+
 	for _, ni := range i.instance.NetworkInterfaces {
 		if ni.AccessConfigs == nil {
 			continue
@@ -471,7 +1221,7 @@ func (i *GCEInstance) getIP() string {
 }
 
 func (i *GCEInstance) refreshInstance() error {
-	inst, err := i.client.Instances.Get(i.projectID, i.ic.Zone.Name, i.instance.Name).Do()
+	inst, err := i.client.Instances.Get(i.projectID, i.zone, i.instance.Name).Do()
 	if err != nil {
 		return err
 	}
@@ -480,26 +1230,33 @@ func (i *GCEInstance) refreshInstance() error {
 	return nil
 }
 
+// UploadScript retries uploadScriptAttempt with an exponential backoff,
+// since the instance may not yet be accepting ssh connections right after
+// boot. It gives up after maxUploadScriptAttempts or when ctx is done,
+// whichever comes first.
 func (i *GCEInstance) UploadScript(ctx gocontext.Context, script []byte) error {
-	uploadedChan := make(chan bool)
-	var uploadErr error = nil
-
-	go func() {
-		for {
-			err := i.uploadScriptAttempt(ctx, script)
-			if err == nil {
-				uploadedChan <- true
-			}
-			uploadErr = err
+	var uploadErr error
+
+	interval := opPollInitialInterval
+	for attempt := 0; attempt < maxUploadScriptAttempts; attempt++ {
+		uploadErr = i.uploadScriptAttempt(ctx, script)
+		if uploadErr == nil || uploadErr == ErrStaleVM {
+			return uploadErr
 		}
-	}()
 
-	select {
-	case <-uploadedChan:
-		return nil
-	case <-ctx.Done():
-		return uploadErr
+		select {
+		case <-ctx.Done():
+			return uploadErr
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > opPollMaxInterval {
+			interval = opPollMaxInterval
+		}
 	}
+
+	return uploadErr
 }
 
 func (i *GCEInstance) uploadScriptAttempt(ctx gocontext.Context, script []byte) error {
@@ -567,38 +1324,13 @@ func (i *GCEInstance) RunScript(ctx gocontext.Context, output io.WriteCloser) (*
 }
 
 func (i *GCEInstance) Stop(ctx gocontext.Context) error {
-	op, err := i.client.Instances.Delete(i.projectID, i.ic.Zone.Name, i.instance.Name).Do()
+	op, err := i.client.Instances.Delete(i.projectID, i.zone, i.instance.Name).Do()
 	if err != nil {
 		return err
 	}
 
-	errChan := make(chan error)
-	go func() {
-		for {
-			newOp, err := i.client.ZoneOperations.Get(i.projectID, i.ic.Zone.Name, op.Name).Do()
-			if err != nil {
-				errChan <- err
-				return
-			}
-
-			if newOp.Status == "DONE" {
-				if newOp.Error != nil {
-					errChan <- &gceOpError{Err: newOp.Error}
-					return
-				}
-
-				errChan <- nil
-				return
-			}
-		}
-	}()
-
-	select {
-	case err := <-errChan:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	_, err = i.provider.waitForOperation(ctx, i.zone, op, i.provider.deleteOperationTimeout)
+	return err
 }
 
 func (i *GCEInstance) ID() string {